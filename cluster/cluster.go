@@ -0,0 +1,296 @@
+// path: akita/flame/cluster/cluster.go
+// Package cluster turns flame.FragmentDirectory into a replicated state machine using
+// hashicorp/raft, so mgpusim experiments can scale fragment placement across multiple
+// host processes instead of being confined to one FragmentDirectory per process.
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"github.com/sarchlab/akita/v4/flame"
+)
+
+// reaperTick is the cadence at which the leader scans its local directory for leases
+// that look expired and proposes their removal through the Raft log.
+const reaperTick = time.Second
+
+// ClusteredFragmentDirectory replicates a flame.FragmentDirectory via Raft across
+// peers. It is NOT a drop-in replacement for *flame.FragmentDirectory: Lookup and
+// ScanForNode keep flame.FragmentDirectory's signatures, but Install, Remove and Renew
+// now return an error (an Apply can fail to commit, e.g. if this node isn't the
+// leader), so callers typed against the concrete *flame.FragmentDirectory — such as
+// flame_integration.PMEngineController.Dir — need their call sites (and, if they want
+// to accept either directory, their field type) updated before they can take a
+// *ClusteredFragmentDirectory instead.
+type ClusteredFragmentDirectory struct {
+	dir  *flame.FragmentDirectory
+	raft *raft.Raft
+	fsm  *fsm
+
+	engine *flame.PMEngine
+
+	reaperQuit chan struct{}
+	reaperWG   sync.WaitGroup
+}
+
+// NewClusteredFragmentDirectory starts (or rejoins) a Raft-replicated FragmentDirectory.
+// nodeID must match one of peers' IDs; that peer's Address is used as this node's Raft
+// bind address. dataDir holds the Raft log/stable BoltDB stores and periodic snapshots,
+// and is created if missing. On first start (no existing Raft state in dataDir), the
+// cluster is bootstrapped with peers as the initial configuration.
+func NewClusteredFragmentDirectory(nodeID raft.ServerID, peers []raft.Server, dataDir string) (*ClusteredFragmentDirectory, error) {
+	bindAddr, err := addressOf(nodeID, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("cluster: create data dir %q: %w", dataDir, err)
+	}
+
+	// NoReaper: lease expiry must be decided once, by the leader, and applied to every
+	// replica through the Raft log (see runReaper/opReap below) — not by each replica's
+	// own wall-clock goroutine independently deciding whether to reap, which would let
+	// replicas diverge on lease-driven mappings depending on their own goroutine timing.
+	dir := flame.NewFragmentDirectoryNoReaper(flame.WallClock{})
+	f := &fsm{dir: dir}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft-log.bolt"))
+	if err != nil {
+		return nil, fmt.Errorf("cluster: open log store: %w", err)
+	}
+
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft-stable.bolt"))
+	if err != nil {
+		return nil, fmt.Errorf("cluster: open stable store: %w", err)
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(dataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: open snapshot store: %w", err)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: resolve %q: %w", bindAddr, err)
+	}
+
+	transport, err := raft.NewTCPTransport(bindAddr, tcpAddr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: create transport: %w", err)
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = nodeID
+
+	r, err := raft.NewRaft(config, f, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: start raft: %w", err)
+	}
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: check existing state: %w", err)
+	}
+	if !hasState {
+		if err := r.BootstrapCluster(raft.Configuration{Servers: peers}).Error(); err != nil {
+			return nil, fmt.Errorf("cluster: bootstrap: %w", err)
+		}
+	}
+
+	c := &ClusteredFragmentDirectory{dir: dir, raft: r, fsm: f, reaperQuit: make(chan struct{})}
+	c.reaperWG.Add(1)
+	go c.runReaper()
+
+	return c, nil
+}
+
+// runReaper is the leader-only loop that drives lease expiry through the Raft log: it
+// wakes every reaperTick and, if this node currently believes it is the leader,
+// proposes removing whatever leases its local directory sees as expired. A stale
+// leader belief is harmless — if this node isn't actually the leader anymore, its
+// Apply just fails and the real leader's own tick picks the lease up instead.
+func (c *ClusteredFragmentDirectory) runReaper() {
+	defer c.reaperWG.Done()
+
+	ticker := time.NewTicker(reaperTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.reaperQuit:
+			return
+		case <-ticker.C:
+			c.reapExpired()
+		}
+	}
+}
+
+// reapExpired finds leases that look expired in the local directory and, for each,
+// proposes an opReap command carrying both the lease end it observed and the "now" it
+// used to decide that — so every replica's fsm reaps against that same pair rather than
+// re-deciding expiry against its own, possibly differently-scheduled, wall clock.
+func (c *ClusteredFragmentDirectory) reapExpired() {
+	if c.raft.State() != raft.Leader {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for _, exp := range c.dir.PeekExpired(now) {
+		data, err := json.Marshal(command{
+			Op:        opReap,
+			VPN:       exp.Key.VPN,
+			Index:     exp.Key.Index,
+			LeaseEnds: exp.LeaseEnds,
+			Now:       now,
+		})
+		if err != nil {
+			continue
+		}
+		// Fire-and-forget: if this Apply fails to commit (e.g. leadership changed
+		// mid-tick), the lease is still tracked and the next tick's leader retries it.
+		c.raft.Apply(data, 10*time.Second)
+	}
+}
+
+// addressOf finds nodeID's Address among peers.
+func addressOf(nodeID raft.ServerID, peers []raft.Server) (string, error) {
+	for _, p := range peers {
+		if p.ID == nodeID {
+			return string(p.Address), nil
+		}
+	}
+	return "", fmt.Errorf("cluster: nodeID %q not present in peers", nodeID)
+}
+
+// SetPMEngine wires the PMEngine that TransferHome uses to physically move fragments
+// whose directory entry it updates. It is optional: TransferHome simply skips the
+// transfer if no engine has been set.
+func (c *ClusteredFragmentDirectory) SetPMEngine(engine *flame.PMEngine) {
+	c.engine = engine
+}
+
+// Lookup serves from the local replica's state machine, which may lag the leader; no
+// staleness bound is applied, and none can be configured. Use LinearizableLookup when
+// a result must reflect every write committed before the call began.
+func (c *ClusteredFragmentDirectory) Lookup(vpn uint64, idx uint16) (flame.FragMapping, bool) {
+	return c.dir.Lookup(vpn, idx)
+}
+
+// LinearizableLookup performs a Raft barrier before serving vpn/idx from local state,
+// guaranteeing the result reflects every write committed before the call began. The
+// barrier only succeeds on the current leader; on any other node it returns an error.
+func (c *ClusteredFragmentDirectory) LinearizableLookup(vpn uint64, idx uint16) (flame.FragMapping, bool, error) {
+	if err := c.raft.Barrier(10 * time.Second).Error(); err != nil {
+		return flame.FragMapping{}, false, fmt.Errorf("cluster: barrier: %w", err)
+	}
+	m, ok := c.dir.Lookup(vpn, idx)
+	return m, ok, nil
+}
+
+// ScanForNode serves from the local replica's state machine; see Lookup's staleness note.
+func (c *ClusteredFragmentDirectory) ScanForNode(node int) map[flame.FragmentKey]flame.FragMapping {
+	return c.dir.ScanForNode(node)
+}
+
+// Install replicates an Install across the cluster via the Raft log; it only returns
+// once the entry is committed (or fails to commit).
+func (c *ClusteredFragmentDirectory) Install(vpn uint64, idx uint16, m flame.FragMapping) error {
+	return c.apply(command{Op: opInstall, VPN: vpn, Index: idx, Mapping: m})
+}
+
+// Remove replicates a Remove across the cluster via the Raft log.
+func (c *ClusteredFragmentDirectory) Remove(vpn uint64, idx uint16) error {
+	return c.apply(command{Op: opRemove, VPN: vpn, Index: idx})
+}
+
+// Renew replicates a Renew across the cluster via the Raft log.
+func (c *ClusteredFragmentDirectory) Renew(vpn uint64, idx uint16, extend time.Duration) error {
+	return c.apply(command{Op: opRenew, VPN: vpn, Index: idx, ExtendNanos: extend.Nanoseconds()})
+}
+
+// TransferHome atomically repoints key's mapping at newNode — the read of the current
+// mapping and the write of its new NodeID happen inside a single committed Raft log
+// entry (fsm.applyTransferHome), so a concurrent Install/Renew elsewhere in the cluster
+// can never land between them the way it could with a separate Lookup-then-Install. If
+// a PMEngine has been set via SetPMEngine, it then enqueues the physical transfer
+// between the old and new node, using the old NodeID that entry reported, so directory
+// state and actual fragment placement never drift apart.
+func (c *ClusteredFragmentDirectory) TransferHome(key flame.FragmentKey, newNode int) error {
+	data, err := json.Marshal(command{Op: opTransferHome, VPN: key.VPN, Index: key.Index, NewNode: newNode})
+	if err != nil {
+		return fmt.Errorf("cluster: encode command: %w", err)
+	}
+
+	future := c.raft.Apply(data, 10*time.Second)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("cluster: transfer home: apply: %w", err)
+	}
+
+	result, ok := future.Response().(transferHomeResult)
+	if !ok {
+		return fmt.Errorf("cluster: transfer home: unexpected fsm response %T", future.Response())
+	}
+	if !result.Found {
+		return fmt.Errorf("cluster: fragment vpn=%#x idx=%d not installed", key.VPN, key.Index)
+	}
+
+	if c.engine == nil || result.OldNode == newNode {
+		return nil
+	}
+
+	req := &flame.TransferRequest{
+		ID:        fmt.Sprintf("transfer-home-%#x-%d-%d", key.VPN, key.Index, newNode),
+		SrcNode:   result.OldNode,
+		DstNode:   newNode,
+		SizeBytes: uint64(result.Mapping.Size),
+		Meta:      fmt.Sprintf("transfer-home vpn=%#x idx=%d", key.VPN, key.Index),
+	}
+	_, err = c.engine.EnqueueTransfer(req)
+	return err
+}
+
+// apply marshals cmd and commits it through the Raft log, applying it via fsm.Apply
+// on every node (including this one) once committed.
+func (c *ClusteredFragmentDirectory) apply(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("cluster: encode command: %w", err)
+	}
+
+	future := c.raft.Apply(data, 10*time.Second)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("cluster: apply: %w", err)
+	}
+	if resp, ok := future.Response().(error); ok && resp != nil {
+		return fmt.Errorf("cluster: apply: %w", resp)
+	}
+	return nil
+}
+
+// IsLeader reports whether this node currently believes it is the Raft leader.
+func (c *ClusteredFragmentDirectory) IsLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// Shutdown stops this node's reaper loop, then gracefully stops its participation in
+// the Raft cluster.
+func (c *ClusteredFragmentDirectory) Shutdown() error {
+	close(c.reaperQuit)
+	c.reaperWG.Wait()
+	return c.raft.Shutdown().Error()
+}
+
+// timeDuration converts nanoseconds, as stored in a command, back to a time.Duration.
+func timeDuration(nanos int64) time.Duration {
+	return time.Duration(nanos)
+}
@@ -0,0 +1,154 @@
+// path: akita/flame/cluster/fsm.go
+// fsm applies FragmentDirectory mutations as Raft log entries, so every node in the
+// cluster ends up with the same directory state regardless of which node an
+// Install/Remove/Renew call originated on.
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/sarchlab/akita/v4/flame"
+)
+
+// opType identifies which FragmentDirectory mutation a command log entry performs.
+type opType string
+
+const (
+	opInstall      opType = "install"
+	opRemove       opType = "remove"
+	opRenew        opType = "renew"
+	opTransferHome opType = "transfer_home"
+	opReap         opType = "reap"
+)
+
+// command is the payload of one Raft log entry.
+type command struct {
+	Op          opType
+	VPN         uint64
+	Index       uint16
+	Mapping     flame.FragMapping
+	ExtendNanos int64
+	NewNode     int   // used by opTransferHome
+	LeaseEnds   int64 // used by opReap: the lease end the proposer observed via PeekExpired
+	Now         int64 // used by opReap: the proposer's clock reading, so every replica reaps against the same "now"
+}
+
+// transferHomeResult is fsm.Apply's response to a committed opTransferHome command,
+// reporting the mapping's NodeID immediately before the transfer was applied so the
+// caller can enqueue the physical move without a second, separately-racing read.
+type transferHomeResult struct {
+	Found   bool
+	OldNode int
+	Mapping flame.FragMapping
+}
+
+// fsm is the raft.FSM backing a ClusteredFragmentDirectory: every committed command
+// is applied to the same underlying flame.FragmentDirectory used for local reads.
+type fsm struct {
+	dir *flame.FragmentDirectory
+}
+
+// Apply applies one committed log entry to the local directory.
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return fmt.Errorf("cluster: decode log entry: %w", err)
+	}
+
+	switch cmd.Op {
+	case opInstall:
+		f.dir.Install(cmd.VPN, cmd.Index, cmd.Mapping)
+	case opRemove:
+		f.dir.Remove(cmd.VPN, cmd.Index)
+	case opRenew:
+		f.dir.Renew(cmd.VPN, cmd.Index, timeDuration(cmd.ExtendNanos))
+	case opTransferHome:
+		return f.applyTransferHome(cmd)
+	case opReap:
+		f.dir.ReapIfExpired(flame.FragmentKey{VPN: cmd.VPN, Index: cmd.Index}, cmd.LeaseEnds, cmd.Now)
+	default:
+		return fmt.Errorf("cluster: unknown op %q", cmd.Op)
+	}
+
+	return nil
+}
+
+// applyTransferHome reads the fragment's current mapping and repoints it at
+// cmd.NewNode, all within this single committed log entry, so a concurrent
+// Install/Renew from another caller can never land between the read and the write
+// the way it could if TransferHome issued a separate Lookup then Install.
+func (f *fsm) applyTransferHome(cmd command) transferHomeResult {
+	m, ok := f.dir.Lookup(cmd.VPN, cmd.Index)
+	if !ok {
+		return transferHomeResult{Found: false}
+	}
+
+	oldNode := m.NodeID
+	m.NodeID = cmd.NewNode
+	f.dir.Install(cmd.VPN, cmd.Index, m)
+
+	return transferHomeResult{Found: true, OldNode: oldNode, Mapping: m}
+}
+
+// Snapshot captures the full directory contents for Raft to persist and later use to
+// fast-forward lagging or new followers, instead of replaying the entire log.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot{entries: toEntries(f.dir.Snapshot())}, nil
+}
+
+// Restore replaces the local directory's contents with a previously captured snapshot.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var entries []snapshotEntry
+	if err := json.NewDecoder(rc).Decode(&entries); err != nil {
+		return fmt.Errorf("cluster: decode snapshot: %w", err)
+	}
+
+	f.dir.Restore(fromEntries(entries))
+	return nil
+}
+
+// snapshotEntry is one (key, mapping) pair. FragmentKey can't be a JSON map key
+// directly (it's a struct, not a string), so snapshots are encoded as a flat slice.
+type snapshotEntry struct {
+	Key     flame.FragmentKey
+	Mapping flame.FragMapping
+}
+
+func toEntries(m map[flame.FragmentKey]flame.FragMapping) []snapshotEntry {
+	out := make([]snapshotEntry, 0, len(m))
+	for k, v := range m {
+		out = append(out, snapshotEntry{Key: k, Mapping: v})
+	}
+	return out
+}
+
+func fromEntries(entries []snapshotEntry) map[flame.FragmentKey]flame.FragMapping {
+	out := make(map[flame.FragmentKey]flame.FragMapping, len(entries))
+	for _, e := range entries {
+		out[e.Key] = e.Mapping
+	}
+	return out
+}
+
+// fsmSnapshot implements raft.FSMSnapshot over a point-in-time copy of the directory.
+type fsmSnapshot struct {
+	entries []snapshotEntry
+}
+
+// Persist writes the snapshot to sink.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.entries); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("cluster: persist snapshot: %w", err)
+	}
+	return sink.Close()
+}
+
+// Release is a no-op: fsmSnapshot holds no resources beyond the copied slice.
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,216 @@
+// path: akita/flame/cmd/flamed/main.go
+// flamed hosts the flame gRPC service (see flame/rpc) so the Python host-scheduler can
+// submit transfers and query the fragment directory without linking against this
+// process. By default it listens on a Unix socket; pass -tcp to listen on TCP instead,
+// optionally secured with mTLS via -cert/-key/-ca. The same binary doubles as a thin
+// CLI: run one of its subcommands to perform a single RPC against an already-running
+// flamed and exit.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/sarchlab/akita/v4/sim"
+
+	"github.com/sarchlab/akita/v4/flame"
+	"github.com/sarchlab/akita/v4/flame/rpc"
+	pb "github.com/sarchlab/akita/v4/flame/rpc/pb" // MODIFY: generated by `go generate` from service.proto
+)
+
+var clientCommands = map[string]bool{
+	"lookup": true,
+	"scan":   true,
+	"cancel": true,
+	"stats":  true,
+}
+
+func main() {
+	if len(os.Args) > 1 && clientCommands[os.Args[1]] {
+		runClient(os.Args[1], os.Args[2:])
+		return
+	}
+	runServe(os.Args[1:])
+}
+
+// runServe starts the flamed gRPC server and blocks until it exits.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("flamed", flag.ExitOnError)
+	socket := fs.String("socket", "/tmp/flamed.sock", "unix socket to listen on (ignored if -tcp is set)")
+	tcpAddr := fs.String("tcp", "", "listen on this TCP address instead of a unix socket, e.g. :50051")
+	certFile := fs.String("cert", "", "server certificate for mTLS (requires -key and -ca)")
+	keyFile := fs.String("key", "", "server private key for mTLS")
+	caFile := fs.String("ca", "", "CA bundle used to verify client certificates for mTLS")
+	fs.Parse(args)
+
+	lis, err := listen(*socket, *tcpAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "flamed: listen:", err)
+		os.Exit(1)
+	}
+
+	opts, err := serverOptions(*certFile, *keyFile, *caFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "flamed: tls:", err)
+		os.Exit(1)
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	engine, dir := newEngineAndDirectory()
+	rpc.NewServer(engine, dir).Register(grpcServer)
+
+	fmt.Fprintln(os.Stderr, "flamed: listening on", lis.Addr())
+	if err := grpcServer.Serve(lis); err != nil {
+		fmt.Fprintln(os.Stderr, "flamed: serve:", err)
+		os.Exit(1)
+	}
+}
+
+func listen(socket, tcpAddr string) (net.Listener, error) {
+	if tcpAddr != "" {
+		return net.Listen("tcp", tcpAddr)
+	}
+	_ = os.Remove(socket)
+	return net.Listen("unix", socket)
+}
+
+func serverOptions(certFile, keyFile, caFile string) ([]grpc.ServerOption, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("flamed: no CA certificates found in %s", caFile)
+	}
+
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+// newEngineAndDirectory wires a standalone PMEngine and FragmentDirectory for flamed
+// to serve when run on its own. Embedding rpc.Server directly inside the mgpusim
+// process, wired to its live sim.Engine, is the intended production setup; this is the
+// fallback for running flamed standalone (e.g. for the Python host-scheduler to poke
+// at fragments without a full simulation attached).
+func newEngineAndDirectory() (*flame.PMEngine, *flame.FragmentDirectory) {
+	simEngine := sim.NewSerialEngine()
+	dir := flame.NewFragmentDirectory(flame.WallClock{}, time.Second)
+	pmEngine := flame.NewPMEngine(simEngine, flame.PMEngineConfig{
+		Policy:           flame.PolicyStrictPriority,
+		DstPorts:         map[int]sim.Port{},
+		DefaultBandwidth: 16 << 30, // 16 GB/s
+	})
+	return pmEngine, dir
+}
+
+// runClient performs a single RPC against a running flamed and prints the result.
+func runClient(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	socket := fs.String("socket", "/tmp/flamed.sock", "unix socket flamed is listening on")
+	tcpAddr := fs.String("tcp", "", "TCP address flamed is listening on, instead of a unix socket")
+	certFile := fs.String("cert", "", "client certificate for mTLS against a -tcp flamed (requires -key and -ca)")
+	keyFile := fs.String("key", "", "client private key for mTLS")
+	caFile := fs.String("ca", "", "CA bundle used to verify flamed's server certificate for mTLS")
+	vpn := fs.Uint64("vpn", 0, "VPN (for lookup)")
+	index := fs.Uint("index", 0, "fragment index (for lookup)")
+	node := fs.Int("node", 0, "node id (for scan)")
+	id := fs.String("id", "", "transfer id (for cancel)")
+	fs.Parse(args)
+
+	conn, err := dial(*socket, *tcpAddr, *certFile, *keyFile, *caFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "flamed:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	client := pb.NewFlameServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		resp any
+		rerr error
+	)
+	switch cmd {
+	case "lookup":
+		resp, rerr = client.LookupFragment(ctx, &pb.LookupFragmentRequest{Vpn: *vpn, Index: uint32(*index)})
+	case "scan":
+		resp, rerr = client.ScanNode(ctx, &pb.ScanNodeRequest{NodeId: int32(*node)})
+	case "cancel":
+		resp, rerr = client.CancelTransfer(ctx, &pb.CancelTransferRequest{Id: *id})
+	case "stats":
+		resp, rerr = client.Stats(ctx, &pb.StatsRequest{})
+	}
+
+	if rerr != nil {
+		fmt.Fprintln(os.Stderr, "flamed:", rerr)
+		os.Exit(1)
+	}
+	fmt.Printf("%+v\n", resp)
+}
+
+func dial(socket, tcpAddr, certFile, keyFile, caFile string) (*grpc.ClientConn, error) {
+	if tcpAddr == "" {
+		return grpc.NewClient("unix:"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	creds, err := clientCredentials(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, fmt.Errorf("flamed: tls: %w", err)
+	}
+	return grpc.NewClient(tcpAddr, grpc.WithTransportCredentials(creds))
+}
+
+// clientCredentials builds the transport credentials dial uses against a -tcp flamed.
+// With no TLS flags set it falls back to insecure.NewCredentials(), matching flamed's
+// own default of plaintext TCP when -cert/-key/-ca are left unset; a server running
+// with mTLS (see serverOptions) requires all three client flags to be set here too.
+func clientCredentials(certFile, keyFile, caFile string) (credentials.TransportCredentials, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("flamed: no CA certificates found in %s", caFile)
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}), nil
+}
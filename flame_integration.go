@@ -24,15 +24,39 @@ import (
 // PMEngineController is embedded into Driver to access PMEngine from mgpusim driver APIs.
 type PMEngineController struct {
 	Engine *flame.PMEngine
+	Dir    *flame.FragmentDirectory
 }
 
-// NewPMEngineController creates a PMEngineController.
-func NewPMEngineController() *PMEngineController {
-	return &PMEngineController{
-		Engine: flame.NewPMEngine(),
+// NewPMEngineController creates a PMEngineController. cfg is forwarded to
+// flame.NewPMEngine; see flame.PMEngineConfig for how policy and links are set. dir's
+// expiry callback is wired so a hot, expiring lease triggers a re-fetch transfer.
+func NewPMEngineController(simEngine sim.Engine, cfg flame.PMEngineConfig, dir *flame.FragmentDirectory) *PMEngineController {
+	p := &PMEngineController{
+		Engine: flame.NewPMEngine(simEngine, cfg),
+		Dir:    dir,
 	}
+
+	dir.RegisterExpiryCallback(func(key flame.FragmentKey, prev flame.FragMapping) {
+		if prev.Flags&FragFlagHot == 0 {
+			return
+		}
+		req := &flame.TransferRequest{
+			ID:        fmt.Sprintf("refetch-%d-%d-%d", key.VPN, key.Index, time.Now().UnixNano()),
+			SrcNode:   prev.NodeID,
+			DstNode:   prev.NodeID,
+			SizeBytes: uint64(prev.Size),
+			Meta:      fmt.Sprintf("refetch vpn=%#x idx=%d", key.VPN, key.Index),
+		}
+		_, _ = p.Engine.EnqueueTransfer(req)
+	})
+
+	return p
 }
 
+// FragFlagHot marks a fragment as hot in FragMapping.Flags; its lease expiring should
+// trigger an automatic re-fetch rather than a silent eviction.
+const FragFlagHot uint32 = 1 << 0
+
 // RequestFragmentTransfer enqueues a transfer on the PMEngine and returns when complete.
 func (p *PMEngineController) RequestFragmentTransfer(ctx context.Context, srcGPU, dstGPU int, sizeBytes uint64, priority int, meta string) error {
 	req := &flame.TransferRequest{
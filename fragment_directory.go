@@ -1,15 +1,49 @@
 // path: akita/flame/fragment_directory.go
-// Lightweight, in-memory Fragment Directory for Akita simulation.
+// Lightweight, sharded, in-memory Fragment Directory for Akita simulation.
 // This sits next to Akita's simulation components and provides a global mapping:
 // (vpn,page_fragment_index) -> (node/gpu, phys_addr, size, flags)
 // NOTE: this is a software-level directory useful for simulation / prototype.
 package flame
 
 import (
+	"container/heap"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// numShards is the number of independently-locked shards backing FragmentDirectory.
+// It must stay a power of two so shardFor can select a shard with a mask instead of
+// a modulo. 256 comfortably spreads millions of fragment lookups/sec across cores.
+const numShards = 256
+
+// scanWorkers bounds the goroutine pool used by ScanForNode and DebugDump so a huge
+// shard count doesn't spawn one goroutine per shard.
+const scanWorkers = 16
+
+// Clock abstracts "now" for lease-expiry comparisons, so tests can drive expiry
+// deterministically (see manualClock in fragment_directory_test.go) instead of racing
+// the wall clock. It does NOT make the background reaper's wake cadence sim-time-aware:
+// runReaper always wakes on a real time.Ticker(reaperTick), so embedding a
+// FragmentDirectory in an Akita simulation that runs faster/slower than real time (or
+// single-steps) still reaps leases on wall-clock/goroutine-scheduling cadence, not
+// simulated time. A caller that needs lease expiry to advance in lockstep with
+// simulated ticks must drive it directly — see NewFragmentDirectoryNoReaper,
+// PeekExpired and ReapIfExpired.
+type Clock interface {
+	Now() int64
+}
+
+// WallClock is a Clock backed by the real-time wall clock, in nanoseconds since epoch.
+// It is not monotonic: it follows adjustments to the system clock.
+type WallClock struct{}
+
+// Now returns time.Now().UnixNano().
+func (WallClock) Now() int64 { return time.Now().UnixNano() }
+
 // FragmentKey identifies a fragment by virtual page (VPN) and fragment index.
 type FragmentKey struct {
 	VPN   uint64 // virtual page number
@@ -22,69 +56,584 @@ type FragMapping struct {
 	PhysAddr  uint64 // simulated physical address (or unique id)
 	Size      uint32 // bytes (e.g., 256, 512, 4096)
 	Replica   bool   // whether this fragment is replicated
-	LeaseEnds int64  // epoch or timestamp when lease expires (simulated)
+	LeaseEnds int64  // clock ticks when lease expires (0 = no lease), per the directory's Clock
 	Flags     uint32 // custom flags (hot, write-heavy, reserved)
 }
 
-// FragmentDirectory is a concurrency-safe directory.
-type FragmentDirectory struct {
+// shard is one independently-locked partition of the directory's fragment map.
+type shard struct {
 	mu   sync.RWMutex
 	data map[FragmentKey]FragMapping
+	size int64 // atomic; mirrors len(data) so Stats() can read it lock-free
+}
+
+// leaseEntry is one element of the directory's expiry min-heap.
+type leaseEntry struct {
+	key       FragmentKey
+	leaseEnds int64
+	index     int
+}
+
+// leaseHeap is a container/heap.Interface ordering entries by soonest expiry, so the
+// reaper never has to walk the whole fragment map to find what to reap next.
+type leaseHeap []*leaseEntry
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].leaseEnds < h[j].leaseEnds }
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x any) {
+	e := x.(*leaseEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *leaseHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// FragmentDirectory is a concurrency-safe, sharded directory.
+type FragmentDirectory struct {
+	shards [numShards]*shard
+
+	clock      Clock
+	leaseMu    sync.Mutex
+	leases     leaseHeap
+	leaseIndex map[FragmentKey]*leaseEntry
+	callbacks  []func(FragmentKey, FragMapping)
+
+	reaperTick time.Duration
+	reaperQuit chan struct{}
+	reaperWG   sync.WaitGroup
+}
+
+// NewFragmentDirectory creates an empty fragment directory and starts its background
+// lease reaper, which wakes up every reaperTick on the real wall clock (via
+// time.NewTicker) to reap mappings whose LeaseEnds has passed according to clock. Pass
+// WallClock{} for real-time leases. clock need not be WallClock{} (tests pass a manual
+// clock to make expiry deterministic), but the reaper's own wake cadence is always
+// real-time regardless of clock — see Clock's doc comment. Callers that must not have a
+// wall-clock-driven goroutine touching the directory's state want
+// NewFragmentDirectoryNoReaper instead.
+func NewFragmentDirectory(clock Clock, reaperTick time.Duration) *FragmentDirectory {
+	d := NewFragmentDirectoryNoReaper(clock)
+	d.reaperTick = reaperTick
+
+	d.reaperWG.Add(1)
+	go d.runReaper()
+
+	return d
 }
 
-// NewFragmentDirectory creates an empty fragment directory.
-func NewFragmentDirectory() *FragmentDirectory {
-	return &FragmentDirectory{
-		data: make(map[FragmentKey]FragMapping),
+// NewFragmentDirectoryNoReaper creates an empty fragment directory without starting
+// any background reaper goroutine. It is for callers that must drive lease expiry
+// themselves rather than let a wall-clock goroutine mutate the directory on its own
+// schedule — e.g. cluster.ClusteredFragmentDirectory, which routes every reap decision
+// through its Raft log so replicas reap in lockstep instead of diverging on whichever
+// node's local goroutine happens to wake up first. Such callers use PeekExpired to find
+// candidates and ReapIfExpired to apply a decision.
+func NewFragmentDirectoryNoReaper(clock Clock) *FragmentDirectory {
+	d := &FragmentDirectory{
+		clock:      clock,
+		leaseIndex: make(map[FragmentKey]*leaseEntry),
+		reaperQuit: make(chan struct{}),
 	}
+	for i := range d.shards {
+		d.shards[i] = &shard{data: make(map[FragmentKey]FragMapping)}
+	}
+	heap.Init(&d.leases)
+
+	return d
+}
+
+// StopReaper stops the background reaper goroutine. Safe to call once.
+func (d *FragmentDirectory) StopReaper() {
+	close(d.reaperQuit)
+	d.reaperWG.Wait()
+}
+
+// shardFor returns the shard that owns fk, chosen by an FNV-1a hash over VPN+Index.
+func (d *FragmentDirectory) shardFor(fk FragmentKey) *shard {
+	return d.shards[shardHash(fk)&(numShards-1)]
 }
 
-// Lookup returns the mapping and true if present.
+// shardHash computes a stable FNV-1a hash of fk over its VPN and Index fields.
+func shardHash(fk FragmentKey) uint32 {
+	var buf [10]byte
+	binary.LittleEndian.PutUint64(buf[0:8], fk.VPN)
+	binary.LittleEndian.PutUint16(buf[8:10], fk.Index)
+
+	h := fnv.New32a()
+	h.Write(buf[:])
+	return h.Sum32()
+}
+
+// Lookup returns the mapping and true if present. It touches only fk's shard.
 func (d *FragmentDirectory) Lookup(vpn uint64, idx uint16) (FragMapping, bool) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
 	fk := FragmentKey{VPN: vpn, Index: idx}
-	m, ok := d.data[fk]
+	s := d.shardFor(fk)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.data[fk]
 	return m, ok
 }
 
-// Install atomically installs/updates a mapping.
+// LookupBatch looks up many keys at once, grouping them by shard so each shard's read
+// lock is taken only once regardless of how many of the batch's keys land in it.
+func (d *FragmentDirectory) LookupBatch(keys []FragmentKey) map[FragmentKey]FragMapping {
+	byShard := make(map[*shard][]FragmentKey)
+	for _, fk := range keys {
+		s := d.shardFor(fk)
+		byShard[s] = append(byShard[s], fk)
+	}
+
+	out := make(map[FragmentKey]FragMapping, len(keys))
+	var mu sync.Mutex
+
+	runPooled(byShardKeys(byShard), func(s *shard) {
+		fks := byShard[s]
+		s.mu.RLock()
+		hits := make(map[FragmentKey]FragMapping, len(fks))
+		for _, fk := range fks {
+			if m, ok := s.data[fk]; ok {
+				hits[fk] = m
+			}
+		}
+		s.mu.RUnlock()
+
+		mu.Lock()
+		for k, v := range hits {
+			out[k] = v
+		}
+		mu.Unlock()
+	})
+
+	return out
+}
+
+// byShardKeys extracts the shard set out of a shard->keys grouping, for runPooled.
+func byShardKeys(byShard map[*shard][]FragmentKey) []*shard {
+	out := make([]*shard, 0, len(byShard))
+	for s := range byShard {
+		out = append(out, s)
+	}
+	return out
+}
+
+// Install atomically installs/updates a mapping. If m.LeaseEnds is nonzero, the
+// fragment is tracked by the reaper and will be reaped once its lease passes.
 func (d *FragmentDirectory) Install(vpn uint64, idx uint16, m FragMapping) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
 	fk := FragmentKey{VPN: vpn, Index: idx}
-	d.data[fk] = m
+	s := d.shardFor(fk)
+
+	s.mu.Lock()
+	_, existed := s.data[fk]
+	s.data[fk] = m
+	if !existed {
+		atomic.AddInt64(&s.size, 1)
+	}
+	s.mu.Unlock()
+
+	d.trackLease(fk, m.LeaseEnds)
+}
+
+// InstallWithLease installs m with LeaseEnds set to lease from now, per the
+// directory's Clock.
+func (d *FragmentDirectory) InstallWithLease(vpn uint64, idx uint16, m FragMapping, lease time.Duration) {
+	m.LeaseEnds = d.clock.Now() + lease.Nanoseconds()
+	d.Install(vpn, idx, m)
+}
+
+// Renew extends the lease of an already-installed fragment by extend, measured from
+// whichever is later: its current LeaseEnds or now. It is a no-op if the fragment is
+// not installed.
+func (d *FragmentDirectory) Renew(vpn uint64, idx uint16, extend time.Duration) bool {
+	fk := FragmentKey{VPN: vpn, Index: idx}
+	s := d.shardFor(fk)
+
+	s.mu.Lock()
+	m, ok := s.data[fk]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	base := d.clock.Now()
+	if m.LeaseEnds > base {
+		base = m.LeaseEnds
+	}
+	m.LeaseEnds = base + extend.Nanoseconds()
+	s.data[fk] = m
+	s.mu.Unlock()
+
+	d.trackLease(fk, m.LeaseEnds)
+	return true
+}
+
+// trackLease adds, updates, or removes fk's entry in the expiry heap to match
+// leaseEnds (0 means "no lease"). It locks the directory's leaseMu, which is always
+// acquired independently of any shard's mu (never nested under it), so Install/Renew/
+// Remove and the reaper can never deadlock against each other.
+func (d *FragmentDirectory) trackLease(fk FragmentKey, leaseEnds int64) {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+
+	existing, tracked := d.leaseIndex[fk]
+
+	if leaseEnds == 0 {
+		if tracked {
+			heap.Remove(&d.leases, existing.index)
+			delete(d.leaseIndex, fk)
+		}
+		return
+	}
+
+	if tracked {
+		existing.leaseEnds = leaseEnds
+		heap.Fix(&d.leases, existing.index)
+		return
+	}
+
+	entry := &leaseEntry{key: fk, leaseEnds: leaseEnds}
+	heap.Push(&d.leases, entry)
+	d.leaseIndex[fk] = entry
+}
+
+// RegisterExpiryCallback registers cb to run whenever a lease expires (on the reaper
+// goroutine, or on ReapIfExpired's caller's goroutine), after the directory has
+// already removed the mapping or downgraded its Replica flag. cb receives the mapping as it stood just before that change.
+func (d *FragmentDirectory) RegisterExpiryCallback(cb func(FragmentKey, FragMapping)) {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+	d.callbacks = append(d.callbacks, cb)
+}
+
+// runReaper periodically reaps expired leases until StopReaper is called.
+func (d *FragmentDirectory) runReaper() {
+	defer d.reaperWG.Done()
+
+	ticker := time.NewTicker(d.reaperTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.reaperQuit:
+			return
+		case <-ticker.C:
+			d.reapExpired()
+		}
+	}
+}
+
+// reapExpired pops every lease whose expiry is at or before now off the min-heap, then
+// — per key, taking only that key's shard lock — either downgrades a replicated
+// mapping or removes a non-replicated one.
+//
+// Between the pop and the shard lock, a concurrent Install/Renew may have already
+// re-tracked fk with a new, still-valid LeaseEnds (trackLease and the shard write
+// happen in separate critical sections). So the popped leaseEnds is re-checked against
+// the mapping's *current* LeaseEnds under the shard lock before mutating anything; if
+// they no longer match, the fragment was renewed out from under the reaper and is left
+// alone (Install/Renew already re-tracked its new expiry).
+func (d *FragmentDirectory) reapExpired() {
+	now := d.clock.Now()
+
+	d.leaseMu.Lock()
+	var expired []leaseEntry
+	for d.leases.Len() > 0 && d.leases[0].leaseEnds <= now {
+		top := heap.Pop(&d.leases).(*leaseEntry)
+		delete(d.leaseIndex, top.key)
+		expired = append(expired, *top)
+	}
+	d.leaseMu.Unlock()
+
+	for _, popped := range expired {
+		if prev, ok := d.applyReap(popped.key, popped.leaseEnds, now); ok {
+			d.runExpiryCallbacks(popped.key, prev)
+		}
+	}
+}
+
+// applyReap downgrades a replicated mapping or removes a non-replicated one, but only
+// if fk's current mapping's LeaseEnds still equals leaseEnds (i.e. it hasn't been
+// renewed since the caller decided to reap it) and that leaseEnds is <= now. It reports
+// whether it changed anything, and the mapping as it stood immediately before the
+// change.
+func (d *FragmentDirectory) applyReap(fk FragmentKey, leaseEnds, now int64) (FragMapping, bool) {
+	s := d.shardFor(fk)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.data[fk]
+	if !ok || m.LeaseEnds == 0 || m.LeaseEnds != leaseEnds || m.LeaseEnds > now {
+		return FragMapping{}, false
+	}
+
+	prev := m
+	if m.Replica {
+		m.Replica = false
+		m.LeaseEnds = 0
+		s.data[fk] = m
+	} else {
+		delete(s.data, fk)
+		atomic.AddInt64(&s.size, -1)
+	}
+
+	return prev, true
+}
+
+// runExpiryCallbacks invokes every registered expiry callback with (fk, prev).
+func (d *FragmentDirectory) runExpiryCallbacks(fk FragmentKey, prev FragMapping) {
+	d.leaseMu.Lock()
+	callbacks := make([]func(FragmentKey, FragMapping), len(d.callbacks))
+	copy(callbacks, d.callbacks)
+	d.leaseMu.Unlock()
+
+	for _, cb := range callbacks {
+		cb(fk, prev)
+	}
+}
+
+// ExpiredLease is a (key, last-known lease end) pair returned by PeekExpired.
+type ExpiredLease struct {
+	Key       FragmentKey
+	LeaseEnds int64
+}
+
+// PeekExpired returns every tracked lease whose expiry is at or before now, without
+// removing anything from the heap or mutating any mapping. It is for callers (like
+// ClusteredFragmentDirectory) that must decide what to reap here but apply that
+// decision somewhere else — e.g. through a replicated log — rather than mutating local
+// state directly from this call.
+func (d *FragmentDirectory) PeekExpired(now int64) []ExpiredLease {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+
+	out := make([]ExpiredLease, 0)
+	for _, e := range d.leases {
+		if e.leaseEnds <= now {
+			out = append(out, ExpiredLease{Key: e.key, LeaseEnds: e.leaseEnds})
+		}
+	}
+	return out
+}
+
+// ReapIfExpired applies the same compare-and-mutate reap decision as the background
+// reaper to a single key, then (if it changed anything) also clears fk's entry from the
+// expiry heap, since — unlike reapExpired's own batch — PeekExpired did not already pop
+// it. It reports whether anything was reaped: false means fk was already
+// renewed/reaped/removed since the caller observed it via PeekExpired, and nothing
+// further needs to happen.
+func (d *FragmentDirectory) ReapIfExpired(fk FragmentKey, leaseEnds, now int64) (FragMapping, bool) {
+	prev, ok := d.applyReap(fk, leaseEnds, now)
+	if !ok {
+		return FragMapping{}, false
+	}
+
+	d.leaseMu.Lock()
+	if existing, tracked := d.leaseIndex[fk]; tracked && existing.leaseEnds == leaseEnds {
+		heap.Remove(&d.leases, existing.index)
+		delete(d.leaseIndex, fk)
+	}
+	d.leaseMu.Unlock()
+
+	d.runExpiryCallbacks(fk, prev)
+	return prev, true
 }
 
 // Remove deletes a fragment mapping.
 func (d *FragmentDirectory) Remove(vpn uint64, idx uint16) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
 	fk := FragmentKey{VPN: vpn, Index: idx}
-	delete(d.data, fk)
+	s := d.shardFor(fk)
+
+	s.mu.Lock()
+	if _, ok := s.data[fk]; ok {
+		delete(s.data, fk)
+		atomic.AddInt64(&s.size, -1)
+	}
+	s.mu.Unlock()
+
+	d.trackLease(fk, 0)
 }
 
-// ScanForNode returns all fragments currently mapped to a node.
+// ScanForNode returns all fragments currently mapped to a node, scanning shards in
+// parallel over a bounded worker pool and merging their results.
 func (d *FragmentDirectory) ScanForNode(node int) map[FragmentKey]FragMapping {
 	out := make(map[FragmentKey]FragMapping)
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	for k, v := range d.data {
-		if v.NodeID == node {
+	var mu sync.Mutex
+
+	runPooled(allShards(&d.shards), func(s *shard) {
+		hits := make(map[FragmentKey]FragMapping)
+		s.mu.RLock()
+		for k, v := range s.data {
+			if v.NodeID == node {
+				hits[k] = v
+			}
+		}
+		s.mu.RUnlock()
+
+		mu.Lock()
+		for k, v := range hits {
 			out[k] = v
 		}
-	}
+		mu.Unlock()
+	})
+
 	return out
 }
 
-// DebugDump prints a compact snapshot (for logs).
+// DebugDump prints a compact snapshot (for logs), scanning shards in parallel over a
+// bounded worker pool and concatenating their output in shard order.
 func (d *FragmentDirectory) DebugDump() string {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+	parts := make([]string, numShards)
+
+	runIndexedPooled(numShards, func(i int) {
+		s := d.shards[i]
+		var sb string
+		s.mu.RLock()
+		for k, v := range s.data {
+			sb += fmt.Sprintf("VPN=%#x idx=%d -> node=%d pa=%#x size=%d lease=%d flags=%#x\n",
+				k.VPN, k.Index, v.NodeID, v.PhysAddr, v.Size, v.LeaseEnds, v.Flags)
+		}
+		s.mu.RUnlock()
+		parts[i] = sb
+	})
+
 	s := "FragmentDirectory Dump:\n"
-	for k, v := range d.data {
-		s += fmt.Sprintf("VPN=%#x idx=%d -> node=%d pa=%#x size=%d lease=%d flags=%#x\n",
-			k.VPN, k.Index, v.NodeID, v.PhysAddr, v.Size, v.LeaseEnds, v.Flags)
+	for _, p := range parts {
+		s += p
 	}
 	return s
 }
+
+// FragmentDirectoryStats is a lock-free snapshot of the directory's shard occupancy.
+type FragmentDirectoryStats struct {
+	NumShards int
+	TotalSize int64
+}
+
+// Stats reports the directory's total fragment count by summing each shard's atomic
+// size counter; it never takes a shard lock.
+func (d *FragmentDirectory) Stats() FragmentDirectoryStats {
+	var total int64
+	for i := range d.shards {
+		total += atomic.LoadInt64(&d.shards[i].size)
+	}
+	return FragmentDirectoryStats{NumShards: numShards, TotalSize: total}
+}
+
+// Snapshot returns every fragment mapping currently installed, scanning shards in
+// parallel. It is meant for callers that need the full directory contents, such as
+// flame/cluster's Raft FSM snapshotting this directory for replication.
+func (d *FragmentDirectory) Snapshot() map[FragmentKey]FragMapping {
+	out := make(map[FragmentKey]FragMapping)
+	var mu sync.Mutex
+
+	runPooled(allShards(&d.shards), func(s *shard) {
+		s.mu.RLock()
+		hits := make(map[FragmentKey]FragMapping, len(s.data))
+		for k, v := range s.data {
+			hits[k] = v
+		}
+		s.mu.RUnlock()
+
+		mu.Lock()
+		for k, v := range hits {
+			out[k] = v
+		}
+		mu.Unlock()
+	})
+
+	return out
+}
+
+// Restore replaces the directory's entire contents with snapshot. Leases are
+// re-tracked as usual via Install, but any in-progress reap of a key absent from
+// snapshot is harmless: the reaper simply finds nothing left to act on.
+func (d *FragmentDirectory) Restore(snapshot map[FragmentKey]FragMapping) {
+	for i := range d.shards {
+		s := d.shards[i]
+		s.mu.Lock()
+		s.data = make(map[FragmentKey]FragMapping)
+		atomic.StoreInt64(&s.size, 0)
+		s.mu.Unlock()
+	}
+	for k, v := range snapshot {
+		d.Install(k.VPN, k.Index, v)
+	}
+}
+
+// allShards returns every shard in shards, for runPooled.
+func allShards(shards *[numShards]*shard) []*shard {
+	out := make([]*shard, numShards)
+	copy(out, shards[:])
+	return out
+}
+
+// runPooled runs fn once per item in items, across a bounded pool of scanWorkers
+// goroutines, and blocks until every call has returned.
+func runPooled(items []*shard, fn func(*shard)) {
+	workers := scanWorkers
+	if workers > len(items) {
+		workers = len(items)
+	}
+	if workers < 1 {
+		return
+	}
+
+	work := make(chan *shard)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				fn(s)
+			}
+		}()
+	}
+	for _, s := range items {
+		work <- s
+	}
+	close(work)
+	wg.Wait()
+}
+
+// runIndexedPooled runs fn(i) for every i in [0,n), across a bounded pool of
+// scanWorkers goroutines, and blocks until every call has returned.
+func runIndexedPooled(n int, fn func(int)) {
+	workers := scanWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		return
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				fn(idx)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,84 @@
+// path: akita/flame/fragment_directory_test.go
+package flame
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// manualClock is a Clock whose Now() is controlled entirely by test code, so lease
+// expiry can be driven deterministically instead of racing the wall clock.
+type manualClock struct {
+	now int64 // atomic
+}
+
+func (c *manualClock) Now() int64 { return atomic.LoadInt64(&c.now) }
+func (c *manualClock) Set(t int64) { atomic.StoreInt64(&c.now, t) }
+
+// TestFragmentDirectory_RenewRacesReap renews a fragment's lease concurrently with the
+// reaper ticking over its old expiry, and asserts the fragment is never evicted or
+// downgraded once it has been renewed to a still-future LeaseEnds. This is the race
+// chunk0-3's reapExpired had to be hardened against: popping a lease off the heap and
+// then blindly acting on "whatever is in the shard map" lets a Renew that lands in the
+// same window be clobbered by a reap of its now-stale lease.
+func TestFragmentDirectory_RenewRacesReap(t *testing.T) {
+	clock := &manualClock{now: 1000}
+	d := NewFragmentDirectory(clock, time.Millisecond)
+	defer d.StopReaper()
+
+	const vpn, idx = 0x1000, 0
+
+	d.InstallWithLease(vpn, idx, FragMapping{NodeID: 1, Replica: true}, 10)
+	// lease now ends at 1010.
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			d.Renew(vpn, idx, 10)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			clock.Set(clock.Now() + 1)
+			d.reapExpired()
+		}
+	}()
+
+	wg.Wait()
+
+	m, ok := d.Lookup(vpn, idx)
+	if !ok {
+		t.Fatal("fragment was evicted despite being continuously renewed")
+	}
+	if !m.Replica {
+		t.Fatal("fragment was downgraded despite being continuously renewed")
+	}
+	if m.LeaseEnds <= clock.Now() {
+		t.Fatalf("lease ended in the past: leaseEnds=%d now=%d", m.LeaseEnds, clock.Now())
+	}
+}
+
+// TestFragmentDirectory_ReapExpiresStaleLease sanity-checks the non-racy path: once
+// renewals stop, the reaper still reaps the fragment once its lease truly passes.
+func TestFragmentDirectory_ReapExpiresStaleLease(t *testing.T) {
+	clock := &manualClock{now: 0}
+	d := NewFragmentDirectory(clock, time.Millisecond)
+	defer d.StopReaper()
+
+	const vpn, idx = 0x2000, 1
+	d.InstallWithLease(vpn, idx, FragMapping{NodeID: 2}, 5)
+
+	clock.Set(100)
+	d.reapExpired()
+
+	if _, ok := d.Lookup(vpn, idx); ok {
+		t.Fatal("expected non-replica fragment to be removed once its lease passed")
+	}
+}
@@ -1,132 +1,495 @@
 // path: akita/flame/pm_engine.go
-// PMEngine: prioritized DMA / RDMA executor stub for Akita simulation.
+// PMEngine: prioritized DMA / RDMA executor for Akita simulation.
 // In a full hardware design the PM-Engine would be a dedicated low-latency DMA/RDMA engine
 // that performs prioritized transfers, TLB prefetches and emits completion events.
-// Here we provide an API to enqueue prioritized transfers that other Akita components can call.
-// This stub uses Akita's sim.Engine messaging primitives (TODO: integrate with actual Akita objects).
-
+// This is a proper Akita ticking component: it schedules itself on the injected sim.Engine,
+// models per-transfer latency in simulated time (not wall-clock time), and posts completion
+// messages on per-destination ports so the rest of the discrete-event simulation can observe
+// transfer completion deterministically.
 package flame
 
 import (
+	"container/heap"
 	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/sarchlab/akita/v4/sim"
+	"github.com/sarchlab/akita/v4/tracing"
+)
+
+// Policy selects how PMEngine orders and admits pending transfers.
+type Policy int
+
+const (
+	// PolicyStrictPriority services pending transfers in Priority order (lower first).
+	// This is the original PMEngine behavior.
+	PolicyStrictPriority Policy = iota
+	// PolicyEDF orders pending transfers by Deadline (earliest first), breaking ties by
+	// Priority. A zero Deadline sorts last.
+	PolicyEDF
+	// PolicyWFQ weighted-fair-queues pending transfers across SrcNode, using a virtual
+	// finish time per source so no single source can starve the others sharing the engine.
+	PolicyWFQ
 )
 
 // TransferRequest describes a prioritized fragment transfer.
 type TransferRequest struct {
-	ID        string
-	SrcNode   int
-	DstNode   int
-	SizeBytes uint64
-	Priority  int    // lower => higher priority
-	Meta      string // optional metadata (e.g., fragment key)
-	Done      chan error
-	// Deadline, lease info etc can be added here.
+	ID          string
+	SrcNode     int
+	DstNode     int
+	SizeBytes   uint64
+	Priority    int       // lower => higher priority
+	Deadline    time.Time // used by PolicyEDF; zero value sorts last
+	Preemptible bool      // whether a higher-precedence request may preempt this mid-flight
+	Meta        string    // optional metadata (e.g., fragment key)
+	Done        chan error
+}
+
+// completionMsg is posted on the destination port when a transfer finishes.
+type completionMsg struct {
+	sim.MsgMeta
+
+	Req *TransferRequest
+	Err error
+}
+
+// Meta returns the message metadata, satisfying sim.Msg.
+func (m *completionMsg) Meta() *sim.MsgMeta {
+	return &m.MsgMeta
+}
+
+// linkKey identifies a directed src->dst link for bandwidth and occupancy lookup.
+type linkKey struct {
+	Src, Dst int
+}
+
+// pendingEntry wraps a TransferRequest with the bookkeeping its ordering policy needs.
+type pendingEntry struct {
+	req      *TransferRequest
+	vft      sim.VTimeInSec // virtual finish time, used by PolicyWFQ
+	heapIdx  int
+}
+
+// pendingHeap is a container/heap.Interface ordering pendingEntries by the engine's
+// configured Policy.
+type pendingHeap struct {
+	policy Policy
+	items  []*pendingEntry
+}
+
+func (h *pendingHeap) Len() int { return len(h.items) }
+
+func (h *pendingHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	return entryLess(h.policy, a, b)
+}
+
+func (h *pendingHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].heapIdx = i
+	h.items[j].heapIdx = j
+}
+
+func (h *pendingHeap) Push(x any) {
+	e := x.(*pendingEntry)
+	e.heapIdx = len(h.items)
+	h.items = append(h.items, e)
+}
+
+func (h *pendingHeap) Pop() any {
+	old := h.items
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	h.items = old[:n-1]
+	return e
+}
+
+// entryLess reports whether a should be serviced before b under policy.
+func entryLess(policy Policy, a, b *pendingEntry) bool {
+	switch policy {
+	case PolicyEDF:
+		ad, bd := a.req.Deadline, b.req.Deadline
+		if ad.IsZero() != bd.IsZero() {
+			return bd.IsZero()
+		}
+		if !ad.Equal(bd) {
+			return ad.Before(bd)
+		}
+		return a.req.Priority < b.req.Priority
+	case PolicyWFQ:
+		return a.vft < b.vft
+	default: // PolicyStrictPriority
+		return a.req.Priority < b.req.Priority
+	}
+}
+
+// inFlightTransfer tracks a transfer currently occupying a link.
+type inFlightTransfer struct {
+	req        *TransferRequest
+	entry      *pendingEntry
+	startedAt  sim.VTimeInSec
+	completeAt sim.VTimeInSec
+}
+
+// PMEngineStats is a snapshot of PMEngine's scheduler state.
+type PMEngineStats struct {
+	Policy          Policy
+	PendingCount    int
+	InFlightCount   int
+	AvgQueueDepth   float64 // mean of PendingCount sampled once per Tick
+	PreemptionCount uint64
+}
+
+func (s PMEngineStats) String() string {
+	return fmt.Sprintf(
+		"PMEngine: policy=%d pending=%d inFlight=%d avgQueueDepth=%.2f preemptions=%d",
+		s.Policy, s.PendingCount, s.InFlightCount, s.AvgQueueDepth, s.PreemptionCount,
+	)
 }
 
-// PMEngine simulates a prioritized DMA engine. It processes requests in priority order.
+// PMEngineConfig collects the parameters needed to construct a PMEngine.
+type PMEngineConfig struct {
+	Freq             sim.Freq
+	Policy           Policy
+	DstPorts         map[int]sim.Port // one outgoing port per destination GPU
+	Bandwidth        map[[2]int]uint64
+	DefaultBandwidth uint64 // used for links not present in Bandwidth, bytes/sec
+}
+
+// PMEngine is an Akita ticking component that simulates a prioritized DMA engine.
+// It admits pending transfers link-by-link according to its configured Policy, and
+// completes them in simulation time rather than real wall-clock time, so it composes
+// with the rest of mgpusim's discrete-event simulation.
 type PMEngine struct {
-	mu       sync.Mutex
-	pending  []*TransferRequest
-	active   bool
-	quit     chan struct{}
-	interval time.Duration // per-transfer simulated latency base
+	*sim.TickingComponent
+
+	mu     sync.Mutex
+	policy Policy
+	// linkQueues holds one pendingHeap per link that currently has pending traffic,
+	// keyed the same way as inFlight. Splitting the single global heap this way means
+	// Tick only has to look at the (typically small) set of links with pending or
+	// in-flight work, instead of draining every pending transfer in the system on
+	// every tick regardless of how many links they're actually contending for.
+	linkQueues map[linkKey]*pendingHeap
+	// pendingCount mirrors the total size of all linkQueues, kept incrementally so
+	// Stats/Tick don't need to sum every queue's length.
+	pendingCount int
+	// inFlight is keyed by link so a link's current occupant, if any, can be found in
+	// O(1) for preemption decisions.
+	inFlight  map[linkKey]*inFlightTransfer
+	dstPorts  map[int]sim.Port
+	bandwidth map[linkKey]uint64
+	// interval is the fixed per-transfer base latency, in simulated seconds,
+	// added on top of the size/bandwidth term.
+	interval sim.VTimeInSec
+	// defaultBandwidth is used for links not present in bandwidth, in bytes/sec.
+	defaultBandwidth uint64
+
+	// wfqVirtualTime and wfqPerSource back PolicyWFQ's virtual finish time computation.
+	wfqVirtualTime sim.VTimeInSec
+	wfqPerSource   map[int]sim.VTimeInSec
+
+	preemptionCount   uint64
+	queueDepthSamples uint64
+	queueDepthTotal   float64
 }
 
-// NewPMEngine creates a new stub PMEngine.
-func NewPMEngine() *PMEngine {
+// NewPMEngine creates a PMEngine driven by the given Akita engine, configured by cfg.
+func NewPMEngine(engine sim.Engine, cfg PMEngineConfig) *PMEngine {
 	e := &PMEngine{
-		pending:  make([]*TransferRequest, 0),
-		quit:     make(chan struct{}),
-		interval: 2 * time.Millisecond, // default simulated per-request base latency; tune in sim
+		policy:           cfg.Policy,
+		linkQueues:       make(map[linkKey]*pendingHeap),
+		inFlight:         make(map[linkKey]*inFlightTransfer),
+		dstPorts:         cfg.DstPorts,
+		bandwidth:        make(map[linkKey]uint64, len(cfg.Bandwidth)),
+		interval:         2e-6, // 2us default simulated per-request base latency; tune in sim
+		defaultBandwidth: cfg.DefaultBandwidth,
+		wfqPerSource:     make(map[int]sim.VTimeInSec),
 	}
-	go e.loop()
+	for k, v := range cfg.Bandwidth {
+		e.bandwidth[linkKey{Src: k[0], Dst: k[1]}] = v
+	}
+	e.TickingComponent = sim.NewTickingComponent("PMEngine", engine, cfg.Freq, e)
 	return e
 }
 
-// EnqueueTransfer enqueues a transfer. Returns channel to wait for completion.
+// queueFor returns (creating if necessary) the pendingHeap for key. Caller holds e.mu.
+func (e *PMEngine) queueFor(key linkKey) *pendingHeap {
+	q, ok := e.linkQueues[key]
+	if !ok {
+		q = &pendingHeap{policy: e.policy}
+		e.linkQueues[key] = q
+	}
+	return q
+}
+
+// EnqueueTransfer enqueues a transfer. It returns a channel that fires with the
+// completion error once the completion event actually fires in simulation time.
 func (e *PMEngine) EnqueueTransfer(req *TransferRequest) (chan error, error) {
 	if req == nil {
 		return nil, errors.New("nil request")
 	}
+
 	e.mu.Lock()
-	defer e.mu.Unlock()
 	req.Done = make(chan error, 1)
-	e.pending = append(e.pending, req)
-	// keep pending sorted by Priority (simple insertion sort for small lists)
-	for i := len(e.pending) - 1; i > 0; i-- {
-		if e.pending[i].Priority < e.pending[i-1].Priority {
-			e.pending[i], e.pending[i-1] = e.pending[i-1], e.pending[i]
-		} else {
-			break
+	key := linkKey{Src: req.SrcNode, Dst: req.DstNode}
+	heap.Push(e.queueFor(key), e.newEntry(req))
+	e.pendingCount++
+	e.mu.Unlock()
+
+	tracing.StartTask(req.ID, "", e, "transfer", "dma_transfer", req)
+
+	e.TickLater()
+
+	return req.Done, nil
+}
+
+// newEntry builds a pendingEntry for req, computing its WFQ virtual finish time if
+// the engine is configured for PolicyWFQ.
+func (e *PMEngine) newEntry(req *TransferRequest) *pendingEntry {
+	entry := &pendingEntry{req: req}
+	if e.policy == PolicyWFQ {
+		start := e.wfqVirtualTime
+		if prev := e.wfqPerSource[req.SrcNode]; prev > start {
+			start = prev
 		}
+		entry.vft = start + sim.VTimeInSec(req.SizeBytes)
+		e.wfqPerSource[req.SrcNode] = entry.vft
 	}
-	return req.Done, nil
+	return entry
 }
 
-// Stop stops the PMEngine loop.
-func (e *PMEngine) Stop() {
-	close(e.quit)
+// linkLatency computes how long sizeBytes takes to service over req's link, in
+// simulated seconds.
+func (e *PMEngine) linkLatency(req *TransferRequest, sizeBytes uint64) sim.VTimeInSec {
+	bw := e.bandwidth[linkKey{Src: req.SrcNode, Dst: req.DstNode}]
+	if bw == 0 {
+		bw = e.defaultBandwidth
+	}
+	if bw == 0 {
+		bw = 1 // avoid division by zero; effectively "instant" beyond base interval
+	}
+
+	xferTime := sim.VTimeInSec(float64(sizeBytes) / float64(bw))
+	latency := e.interval + xferTime
+	if req.Priority <= 0 {
+		latency /= 2
+	}
+
+	return latency
 }
 
-// loop simulates executing transfers one-by-one (priority order).
-func (e *PMEngine) loop() {
-	for {
-		select {
-		case <-e.quit:
-			return
-		default:
+// Tick admits pending transfers onto any free or preemptable link and delivers any
+// in-flight transfers whose completion time has arrived.
+func (e *PMEngine) Tick() bool {
+	madeProgress := false
+	now := e.CurrentTime()
+
+	e.mu.Lock()
+
+	var done []*inFlightTransfer
+	for k, t := range e.inFlight {
+		if t.completeAt <= now {
+			done = append(done, t)
+			delete(e.inFlight, k)
+			madeProgress = true
 		}
-		e.mu.Lock()
-		if len(e.pending) == 0 {
-			e.mu.Unlock()
-			time.Sleep(1 * time.Millisecond)
+	}
+
+	e.queueDepthSamples++
+	e.queueDepthTotal += float64(e.pendingCount)
+
+	madeProgress = e.admitPending(now) || madeProgress
+
+	// Keep ticking while anything is in flight, so each transfer is delivered once
+	// its completeAt arrives.
+	if len(e.inFlight) > 0 {
+		madeProgress = true
+	}
+
+	e.mu.Unlock()
+
+	for _, t := range done {
+		e.complete(t.req, nil)
+	}
+
+	return madeProgress
+}
+
+// admitPending considers each link that currently has pending traffic exactly once:
+// a free link admits its best-ranked pending entry; a busy link is only disturbed if
+// that entry's precedence beats the current occupant's (checked via a cheap peek, no
+// pop) and the occupant is Preemptible. This costs O(activeLinks) heap operations per
+// tick rather than O(P log P) over the entire pending set, so ticking remains cheap
+// even with thousands of in-flight/pending transfers queued behind a handful of links.
+// Caller holds e.mu.
+func (e *PMEngine) admitPending(now sim.VTimeInSec) bool {
+	admittedAny := false
+
+	for key, q := range e.linkQueues {
+		if q.Len() == 0 {
+			delete(e.linkQueues, key)
 			continue
 		}
-		req := e.pending[0]
-		e.pending = e.pending[1:]
-		e.mu.Unlock()
-
-		// Simulate servicing: base latency + size-dependent delay
-		latency := e.interval + time.Duration(req.SizeBytes/ (1<<20)) * 1*time.Millisecond
-		// faster if high priority: subtract tiny amount
-		if req.Priority <= 0 {
-			latency /= 2
+
+		if occupant, busy := e.inFlight[key]; busy {
+			top := q.items[0]
+			if !occupant.req.Preemptible || !entryLess(e.policy, top, occupant.entry) {
+				continue // no admittable improvement for this link this tick
+			}
+			e.preempt(key, occupant, now)
+		}
+
+		entry := heap.Pop(q).(*pendingEntry)
+		e.pendingCount--
+		if e.policy == PolicyWFQ && entry.vft > e.wfqVirtualTime {
+			// WFQ virtual time follows the finish time of the entry entering service.
+			e.wfqVirtualTime = entry.vft
 		}
+		e.inFlight[key] = &inFlightTransfer{
+			req:        entry.req,
+			entry:      entry,
+			startedAt:  now,
+			completeAt: now + e.linkLatency(entry.req, entry.req.SizeBytes),
+		}
+		admittedAny = true
+
+		if q.Len() == 0 {
+			delete(e.linkQueues, key)
+		}
+	}
 
-		// If there were real Akita components, we'd post events on the sim engine.
-		// For now we simulate with a goroutine and call Done when complete.
-		go func(r *TransferRequest, l time.Duration) {
-			time.Sleep(l)
-			// mark done
-			select {
-			case r.Done <- nil:
-			default:
+	return admittedAny
+}
+
+// preempt evicts occupant from key's link and re-enqueues its remaining bytes onto
+// that same link's queue. Caller holds e.mu.
+func (e *PMEngine) preempt(key linkKey, occupant *inFlightTransfer, now sim.VTimeInSec) {
+	total := e.linkLatency(occupant.req, occupant.req.SizeBytes)
+	elapsed := now - occupant.startedAt
+	frac := float64(elapsed) / float64(total)
+	if frac < 0 {
+		frac = 0
+	}
+	if frac > 1 {
+		frac = 1
+	}
+
+	transferred := uint64(float64(occupant.req.SizeBytes) * frac)
+	occupant.req.SizeBytes -= transferred
+
+	heap.Push(e.queueFor(key), e.newEntry(occupant.req))
+	e.pendingCount++
+	e.preemptionCount++
+}
+
+// complete delivers the completion message on the destination port, finalizes the
+// tracing span, and signals the request's Done channel.
+func (e *PMEngine) complete(req *TransferRequest, err error) {
+	tracing.EndTask(req.ID, e)
+
+	if port := e.dstPorts[req.DstNode]; port != nil {
+		msg := &completionMsg{Req: req, Err: err}
+		msg.Src = port
+		_ = port.Send(msg) // best-effort: a full destination queue should not block completion
+	}
+
+	select {
+	case req.Done <- err:
+	default:
+	}
+}
+
+// errCanceled is delivered on Done when Cancel removes or aborts a transfer.
+var errCanceled = errors.New("transfer canceled")
+
+// Cancel removes the transfer identified by id from the queue if it has not started
+// yet, or aborts it mid-flight if its Preemptible flag allows. It reports whether the
+// transfer was canceled at all, and whether that required preempting an in-flight
+// transfer (as opposed to simply dequeuing a pending one).
+func (e *PMEngine) Cancel(id string) (canceled, preempted bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for key, q := range e.linkQueues {
+		for i, entry := range q.items {
+			if entry.req.ID != id {
+				continue
 			}
-		}(req, latency)
+			heap.Remove(q, i)
+			e.pendingCount--
+			if q.Len() == 0 {
+				delete(e.linkQueues, key)
+			}
+			e.finishCanceled(entry.req)
+			return true, false
+		}
+	}
+
+	for key, t := range e.inFlight {
+		if t.req.ID != id {
+			continue
+		}
+		if !t.req.Preemptible {
+			return false, false
+		}
+		delete(e.inFlight, key)
+		e.finishCanceled(t.req)
+		return true, true
+	}
+
+	return false, false
+}
+
+// finishCanceled closes out req's tracing span and signals Done with errCanceled.
+// Caller holds e.mu.
+func (e *PMEngine) finishCanceled(req *TransferRequest) {
+	tracing.EndTask(req.ID, e)
+	select {
+	case req.Done <- errCanceled:
+	default:
 	}
 }
 
-// SubmitWithContext provides a convenience function that waits until completion or context cancel.
+// SubmitWithContext submits req and waits for completion or context cancellation,
+// recording a start/end task span visible in Akita traces for req.ID.
 func (e *PMEngine) SubmitWithContext(ctx context.Context, req *TransferRequest) error {
 	done, err := e.EnqueueTransfer(req)
 	if err != nil {
 		return err
 	}
+
 	select {
 	case <-ctx.Done():
+		// The caller has given up: cancel the transfer so it stops holding a link
+		// slot/bandwidth and its tracing span closes now rather than whenever it
+		// would otherwise have completed.
+		e.Cancel(req.ID)
 		return ctx.Err()
 	case err := <-done:
 		return err
 	}
 }
 
-// Debug: simple stats
-func (e *PMEngine) Stats() string {
+// Stats returns a snapshot of the scheduler's queue occupancy and preemption counts.
+func (e *PMEngine) Stats() PMEngineStats {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	return fmt.Sprintf("PMEngine: pending=%d", len(e.pending))
+
+	avg := 0.0
+	if e.queueDepthSamples > 0 {
+		avg = e.queueDepthTotal / float64(e.queueDepthSamples)
+	}
+
+	return PMEngineStats{
+		Policy:          e.policy,
+		PendingCount:    e.pendingCount,
+		InFlightCount:   len(e.inFlight),
+		AvgQueueDepth:   avg,
+		PreemptionCount: e.preemptionCount,
+	}
 }
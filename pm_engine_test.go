@@ -0,0 +1,142 @@
+// path: akita/flame/pm_engine_test.go
+package flame
+
+import (
+	"container/heap"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sarchlab/akita/v4/sim"
+)
+
+// TestEntryLess_EDFOrdersByDeadlineThenPriorityThenZeroLast exercises entryLess under
+// PolicyEDF across a mix of deadlines, a priority tiebreak on equal deadlines, and a
+// zero Deadline (which must sort last regardless of priority).
+func TestEntryLess_EDFOrdersByDeadlineThenPriorityThenZeroLast(t *testing.T) {
+	base := time.Unix(1000, 0)
+
+	q := &pendingHeap{policy: PolicyEDF}
+	heap.Init(q)
+
+	push := func(id string, deadline time.Time, priority int) {
+		heap.Push(q, &pendingEntry{req: &TransferRequest{ID: id, Deadline: deadline, Priority: priority}})
+	}
+
+	push("no-deadline", time.Time{}, 0)
+	push("late", base.Add(time.Hour), 5)
+	push("early-low-pri", base, 9)
+	push("early-high-pri", base, 1)
+
+	var order []string
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(q).(*pendingEntry).req.ID)
+	}
+
+	want := []string{"early-high-pri", "early-low-pri", "late", "no-deadline"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("EDF pop order = %v, want %v", order, want)
+	}
+}
+
+// TestNewEntry_WFQDoesNotStarveSourceBehindAFloodingPeer enqueues one request from
+// source 1 in between a burst of requests from source 0, then lets source 0 keep
+// flooding after it. Under PolicyWFQ, source 1's virtual finish time is computed once,
+// when it arrives, and never recomputed — so source 0 submitting more requests later
+// must not be able to push source 1's entry further back in the queue.
+func TestNewEntry_WFQDoesNotStarveSourceBehindAFloodingPeer(t *testing.T) {
+	e := &PMEngine{policy: PolicyWFQ, wfqPerSource: make(map[int]sim.VTimeInSec)}
+
+	q := &pendingHeap{policy: PolicyWFQ}
+	heap.Init(q)
+
+	heap.Push(q, e.newEntry(&TransferRequest{ID: "src0-0", SrcNode: 0, SizeBytes: 100}))
+	heap.Push(q, e.newEntry(&TransferRequest{ID: "src1-0", SrcNode: 1, SizeBytes: 100}))
+	for i := 1; i <= 4; i++ {
+		heap.Push(q, e.newEntry(&TransferRequest{ID: fmt.Sprintf("src0-%d", i), SrcNode: 0, SizeBytes: 100}))
+	}
+
+	var order []string
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(q).(*pendingEntry).req.ID)
+	}
+
+	pos := indexOf(order, "src1-0")
+	if pos < 0 {
+		t.Fatal("source 1's request vanished from the queue")
+	}
+	if pos > 1 {
+		t.Fatalf("source 0 flooding 4 more requests after source 1 enqueued should not starve "+
+			"source 1: src1-0 ended up at position %d of %d: %v", pos, len(order), order)
+	}
+}
+
+func indexOf(xs []string, want string) int {
+	for i, x := range xs {
+		if x == want {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestAdmitPending_PreemptsLowerPrecedenceOccupant builds a link with a Preemptible
+// occupant already in flight and a higher-precedence entry waiting behind it, and
+// checks that admitPending preempts the occupant: its remaining SizeBytes reflects only
+// the bytes not yet transferred, it is requeued on the same link, PreemptionCount is
+// incremented, and the higher-precedence request now occupies the link.
+func TestAdmitPending_PreemptsLowerPrecedenceOccupant(t *testing.T) {
+	e := &PMEngine{
+		policy:           PolicyStrictPriority,
+		linkQueues:       make(map[linkKey]*pendingHeap),
+		inFlight:         make(map[linkKey]*inFlightTransfer),
+		bandwidth:        make(map[linkKey]uint64),
+		defaultBandwidth: 100, // bytes/sec
+	}
+
+	key := linkKey{Src: 1, Dst: 2}
+
+	occupantReq := &TransferRequest{ID: "occupant", Priority: 5, SizeBytes: 1000, Preemptible: true}
+	e.inFlight[key] = &inFlightTransfer{
+		req:        occupantReq,
+		entry:      &pendingEntry{req: occupantReq},
+		startedAt:  0,
+		completeAt: 20,
+	}
+
+	higherReq := &TransferRequest{ID: "higher", Priority: 0, SizeBytes: 500}
+	q := &pendingHeap{policy: PolicyStrictPriority}
+	heap.Init(q)
+	heap.Push(q, &pendingEntry{req: higherReq})
+	e.linkQueues[key] = q
+	e.pendingCount = 1
+
+	admitted := e.admitPending(5)
+
+	if !admitted {
+		t.Fatal("expected admitPending to report progress")
+	}
+	if e.preemptionCount != 1 {
+		t.Fatalf("expected PreemptionCount=1, got %d", e.preemptionCount)
+	}
+	if occupantReq.SizeBytes != 500 {
+		t.Fatalf("expected occupant's SizeBytes to shrink to the bytes not yet transferred (500), got %d", occupantReq.SizeBytes)
+	}
+
+	occupant, ok := e.inFlight[key]
+	if !ok || occupant.req.ID != "higher" {
+		t.Fatalf("expected the higher-precedence request to now occupy the link, got %+v", occupant)
+	}
+
+	requeued := e.linkQueues[key]
+	if requeued == nil || requeued.Len() != 1 {
+		t.Fatalf("expected the preempted occupant to be requeued on the same link, got %v", requeued)
+	}
+	if requeued.items[0].req.ID != "occupant" {
+		t.Fatalf("expected the requeued entry to be the preempted occupant, got %q", requeued.items[0].req.ID)
+	}
+	if e.pendingCount != 1 {
+		t.Fatalf("expected pendingCount=1 (the requeued occupant), got %d", e.pendingCount)
+	}
+}
@@ -0,0 +1,4 @@
+// path: akita/flame/rpc/generate.go
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative service.proto
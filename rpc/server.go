@@ -0,0 +1,207 @@
+// path: akita/flame/rpc/server.go
+// Server implements FlameService (see service.proto) on top of a live PMEngine and
+// FragmentDirectory, so the Python host-scheduler mentioned in flame_integration.go
+// has an actual RPC endpoint to call instead of just a comment.
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/sarchlab/akita/v4/flame"
+	pb "github.com/sarchlab/akita/v4/flame/rpc/pb" // MODIFY: generated by `go generate` from service.proto
+)
+
+// completionSub is one StreamCompletions subscriber.
+type completionSub struct {
+	metaPrefix string
+	ch         chan *pb.TransferProgress
+}
+
+// Server implements pb.FlameServiceServer on top of a PMEngine and FragmentDirectory.
+type Server struct {
+	pb.UnimplementedFlameServiceServer
+
+	engine *flame.PMEngine
+	dir    *flame.FragmentDirectory
+
+	mu        sync.Mutex
+	subs      map[int]*completionSub
+	nextSubID int
+}
+
+// NewServer creates a Server wrapping engine and dir.
+func NewServer(engine *flame.PMEngine, dir *flame.FragmentDirectory) *Server {
+	return &Server{
+		engine: engine,
+		dir:    dir,
+		subs:   make(map[int]*completionSub),
+	}
+}
+
+// Register registers s as the FlameService implementation on grpcServer.
+func (s *Server) Register(grpcServer *grpc.Server) {
+	pb.RegisterFlameServiceServer(grpcServer, s)
+}
+
+// SubmitTransfer enqueues req on the PMEngine and streams its progress through to
+// completion.
+func (s *Server) SubmitTransfer(req *pb.SubmitTransferRequest, stream pb.FlameService_SubmitTransferServer) error {
+	tr := &flame.TransferRequest{
+		ID:          req.Id,
+		SrcNode:     int(req.SrcNode),
+		DstNode:     int(req.DstNode),
+		SizeBytes:   req.SizeBytes,
+		Priority:    int(req.Priority),
+		Preemptible: req.Preemptible,
+		Meta:        req.Meta,
+	}
+	if req.DeadlineUnixNano != 0 {
+		tr.Deadline = time.Unix(0, req.DeadlineUnixNano)
+	}
+
+	done, err := s.engine.EnqueueTransfer(tr)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&pb.TransferProgress{Id: tr.ID, State: pb.TransferProgress_QUEUED}); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		progress := &pb.TransferProgress{Id: tr.ID, State: pb.TransferProgress_COMPLETED}
+		if err != nil {
+			progress.State = pb.TransferProgress_FAILED
+			progress.Error = err.Error()
+		}
+		s.publish(progress, tr.Meta)
+		return stream.Send(progress)
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+}
+
+// CancelTransfer removes a not-yet-started request from the PMEngine's queue, or
+// aborts it in-flight if it was submitted as Preemptible.
+func (s *Server) CancelTransfer(ctx context.Context, req *pb.CancelTransferRequest) (*pb.CancelTransferResponse, error) {
+	canceled, preempted := s.engine.Cancel(req.Id)
+	return &pb.CancelTransferResponse{Canceled: canceled, Preempted: preempted}, nil
+}
+
+// StreamCompletions is a fan-out subscription over transfer completions, optionally
+// filtered to those whose Meta has the given prefix, so multiple Python schedulers can
+// co-exist against one PMEngine.
+func (s *Server) StreamCompletions(req *pb.StreamCompletionsRequest, stream pb.FlameService_StreamCompletionsServer) error {
+	sub := &completionSub{metaPrefix: req.MetaPrefix, ch: make(chan *pb.TransferProgress, 64)}
+
+	s.mu.Lock()
+	id := s.nextSubID
+	s.nextSubID++
+	s.subs[id] = sub
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, id)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case p := <-sub.ch:
+			if err := stream.Send(p); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// publish fans progress out to every subscriber whose prefix matches meta.
+func (s *Server) publish(progress *pb.TransferProgress, meta string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subs {
+		if sub.metaPrefix != "" && !strings.HasPrefix(meta, sub.metaPrefix) {
+			continue
+		}
+		select {
+		case sub.ch <- progress:
+		default: // slow subscriber; drop rather than block the engine
+		}
+	}
+}
+
+// LookupFragment looks up one fragment.
+func (s *Server) LookupFragment(ctx context.Context, req *pb.LookupFragmentRequest) (*pb.LookupFragmentResponse, error) {
+	m, ok := s.dir.Lookup(req.Vpn, uint16(req.Index))
+	if !ok {
+		return &pb.LookupFragmentResponse{Found: false}, nil
+	}
+	return &pb.LookupFragmentResponse{Found: true, Mapping: toPBMapping(m)}, nil
+}
+
+// InstallFragment installs or updates one fragment, optionally with a lease.
+func (s *Server) InstallFragment(ctx context.Context, req *pb.InstallFragmentRequest) (*pb.InstallFragmentResponse, error) {
+	m := fromPBMapping(req.Mapping)
+	if req.LeaseNanos > 0 {
+		s.dir.InstallWithLease(req.Vpn, uint16(req.Index), m, time.Duration(req.LeaseNanos))
+	} else {
+		s.dir.Install(req.Vpn, uint16(req.Index), m)
+	}
+	return &pb.InstallFragmentResponse{}, nil
+}
+
+// ScanNode returns every fragment currently mapped to a node.
+func (s *Server) ScanNode(ctx context.Context, req *pb.ScanNodeRequest) (*pb.ScanNodeResponse, error) {
+	hits := s.dir.ScanForNode(int(req.NodeId))
+	out := make(map[string]*pb.FragMapping, len(hits))
+	for k, v := range hits {
+		out[fmt.Sprintf("%d:%d", k.VPN, k.Index)] = toPBMapping(v)
+	}
+	return &pb.ScanNodeResponse{Fragments: out}, nil
+}
+
+// Stats reports PMEngine and FragmentDirectory occupancy in one round trip.
+func (s *Server) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	pmStats := s.engine.Stats()
+	dirStats := s.dir.Stats()
+	return &pb.StatsResponse{
+		PmPending:         int64(pmStats.PendingCount),
+		PmInFlight:        int64(pmStats.InFlightCount),
+		PmAvgQueueDepth:   pmStats.AvgQueueDepth,
+		PmPreemptions:     pmStats.PreemptionCount,
+		DirTotalFragments: dirStats.TotalSize,
+		DirNumShards:      int32(dirStats.NumShards),
+	}, nil
+}
+
+func toPBMapping(m flame.FragMapping) *pb.FragMapping {
+	return &pb.FragMapping{
+		NodeId:    int32(m.NodeID),
+		PhysAddr:  m.PhysAddr,
+		Size:      m.Size,
+		Replica:   m.Replica,
+		LeaseEnds: m.LeaseEnds,
+		Flags:     m.Flags,
+	}
+}
+
+func fromPBMapping(m *pb.FragMapping) flame.FragMapping {
+	return flame.FragMapping{
+		NodeID:    int(m.NodeId),
+		PhysAddr:  m.PhysAddr,
+		Size:      m.Size,
+		Replica:   m.Replica,
+		LeaseEnds: m.LeaseEnds,
+		Flags:     m.Flags,
+	}
+}